@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminConfig bundles the state the admin API acts on: direct access to the
+// cache store (bypassing the public fileServer's singleflight/TTL
+// machinery, which isn't needed for these operator-triggered actions) plus
+// hooks into the running default-version poller.
+type AdminConfig struct {
+	Store          BlobStore
+	Sources        []Source
+	Client         *http.Client
+	RefreshDefault func()
+}
+
+// AdminMux builds the handler for the internal admin API. It's bound to its
+// own address via $CRA_PROXY_ADMIN_BIND rather than being mounted on the
+// public listener, since it exposes cache eviction and isn't meant to be
+// reachable by end users.
+func AdminMux(cfg AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/versions", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		entries, err := cfg.Store.List("")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, summarizeVersions(entries))
+	})
+
+	mux.HandleFunc("/cache/", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodDelete {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		version := strings.TrimPrefix(req.URL.Path, "/cache/")
+		if !isValidVersion(version) {
+			http.Error(rw, "invalid version", http.StatusBadRequest)
+			return
+		}
+		if err := evictVersion(cfg.Store, version); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/refresh-default", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cfg.RefreshDefault == nil {
+			http.Error(rw, "no default version source configured", http.StatusNotFound)
+			return
+		}
+		cfg.RefreshDefault()
+		rw.WriteHeader(http.StatusAccepted)
+	})
+
+	mux.HandleFunc("/prefetch/", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		version := strings.TrimPrefix(req.URL.Path, "/prefetch/")
+		if !isValidVersion(version) {
+			http.Error(rw, "invalid version", http.StatusBadRequest)
+			return
+		}
+		if err := prefetchVersion(cfg.Client, cfg.Sources, cfg.Store, version); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	})
+
+	return mux
+}
+
+// VersionSummary is one entry in the GET /versions response: a cached
+// version directory, its total size, and the most recent ModTime among its
+// entries (used as a proxy for last access, since Touch bumps ModTime on
+// every revalidation hit).
+type VersionSummary struct {
+	Version    string    `json:"version"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"lastAccess"`
+}
+
+func summarizeVersions(entries []Entry) []VersionSummary {
+	byVersion := map[string]*VersionSummary{}
+	var order []string
+
+	for _, e := range entries {
+		version, _, _ := strings.Cut(strings.TrimPrefix(e.Name, "/"), "/")
+		if version == "" {
+			continue
+		}
+		summary, ok := byVersion[version]
+		if !ok {
+			summary = &VersionSummary{Version: version}
+			byVersion[version] = summary
+			order = append(order, version)
+		}
+		summary.Size += e.Size
+		if e.ModTime.After(summary.LastAccess) {
+			summary.LastAccess = e.ModTime
+		}
+	}
+
+	sort.Strings(order)
+	summaries := make([]VersionSummary, 0, len(order))
+	for _, version := range order {
+		summaries = append(summaries, *byVersion[version])
+	}
+	return summaries
+}
+
+// isValidVersion reports whether version is safe to use as a single cache
+// path segment: non-empty, no path separators, and not "." or ".." (which
+// would resolve to the store root or its parent and turn a single-version
+// operation into a wipe of the whole cache).
+func isValidVersion(version string) bool {
+	if version == "" || version == "." || version == ".." {
+		return false
+	}
+	return !strings.ContainsAny(version, "/\\")
+}
+
+// evictVersion deletes every cached entry under version's subtree.
+func evictVersion(store BlobStore, version string) error {
+	entries, err := store.List(version)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := store.Delete(e.Name); err != nil {
+			return fmt.Errorf("deleting %s: %w", e.Name, err)
+		}
+	}
+	return nil
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("ERROR: encoding admin response: %s", err.Error())
+	}
+}
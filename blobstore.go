@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotExist is wrapped by the error BlobStore.Get and BlobStore.Stat
+// return when name has never been cached.
+var ErrBlobNotExist = errors.New("blobstore: object does not exist")
+
+// Meta is the metadata a BlobStore persists alongside a cached object's
+// body: the upstream response's status and headers, plus when it was
+// stored - used to decide when an entry needs revalidating.
+type Meta struct {
+	StatusCode int
+	Header     http.Header
+	Size       int64
+	ModTime    time.Time
+}
+
+// Blob is a handle on a stored object's body, opened for random access so
+// that a live reader can tail an object while fileServer is still writing
+// it.
+type Blob interface {
+	io.ReaderAt
+	Size() int64
+	Close() error
+}
+
+// Entry describes one cached object, as returned by BlobStore.List - used
+// by the admin API to report on and evict cached versions.
+type Entry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore is the storage backend fileServer caches objects in. This
+// replaces direct use of http.Dir/os.Create so the cache can live on local
+// disk or in a shared bucket, letting multiple proxy replicas share one
+// cache.
+type BlobStore interface {
+	Get(name string) (Blob, Meta, error)
+	Put(name string, meta Meta, body io.Reader) error
+	// Touch refreshes an entry's ModTime without changing its body, for
+	// the 304-Not-Modified case of cache revalidation.
+	Touch(name string) error
+	Stat(name string) (Meta, error)
+	Delete(name string) error
+	// List returns every cached entry whose name has the given prefix, for
+	// the admin API's version listing and eviction.
+	List(prefix string) ([]Entry, error)
+}
+
+// NewBlobStore builds the BlobStore described by backend: an "s3://" URL
+// selects the S3-compatible backend (also used for GCS via its S3
+// interoperability API); anything else is treated as a local directory
+// path.
+func NewBlobStore(backend string) (BlobStore, error) {
+	if strings.HasPrefix(backend, "s3://") {
+		return newS3BlobStore(backend)
+	}
+	return newLocalBlobStore(backend), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localBlobStore stores each object as a plain file under root, with a
+// "<name>.meta.json" sidecar holding the status code and headers. The
+// body's mtime is used directly as Meta.ModTime.
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) *localBlobStore {
+	return &localBlobStore{root: root}
+}
+
+type localMeta struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+}
+
+// bodyPath computes the on-disk path for a cached object name, rooted at
+// s.root. Taken from http.Dir.Open.
+func (s *localBlobStore) bodyPath(name string) (string, error) {
+	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
+		return "", errors.New("blobstore: invalid character in file path")
+	}
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name))), nil
+}
+
+func (s *localBlobStore) Get(name string) (Blob, Meta, error) {
+	bodyPath, err := s.bodyPath(name)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+
+	// Read the meta sidecar before opening the body: Put renames the body
+	// into place first, so the body opened here is never older than the
+	// meta just read.
+	meta, err := s.Stat(name)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+
+	f, err := os.Open(bodyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, Meta{}, fmt.Errorf("%s: %w", name, ErrBlobNotExist)
+		}
+		return nil, Meta{}, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Meta{}, err
+	}
+	meta.Size = fi.Size()
+	meta.ModTime = fi.ModTime()
+
+	return &localBlob{f: f, size: fi.Size()}, meta, nil
+}
+
+func (s *localBlobStore) Stat(name string) (Meta, error) {
+	bodyPath, err := s.bodyPath(name)
+	if err != nil {
+		return Meta{}, err
+	}
+
+	fi, err := os.Stat(bodyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Meta{}, fmt.Errorf("%s: %w", name, ErrBlobNotExist)
+		}
+		return Meta{}, err
+	}
+
+	return s.readMeta(bodyPath, fi)
+}
+
+func (s *localBlobStore) readMeta(bodyPath string, fi os.FileInfo) (Meta, error) {
+	metaBytes, err := os.ReadFile(bodyPath + ".meta.json")
+	if err != nil {
+		return Meta{}, err
+	}
+
+	var lm localMeta
+	if err := json.Unmarshal(metaBytes, &lm); err != nil {
+		return Meta{}, err
+	}
+
+	return Meta{
+		StatusCode: lm.StatusCode,
+		Header:     lm.Header,
+		Size:       fi.Size(),
+		ModTime:    fi.ModTime(),
+	}, nil
+}
+
+func (s *localBlobStore) Put(name string, meta Meta, body io.Reader) error {
+	bodyPath, err := s.bodyPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(bodyPath), os.FileMode(0770)); err != nil {
+		return err
+	}
+
+	tmpBody, err := os.CreateTemp(filepath.Dir(bodyPath), filepath.Base(bodyPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpBodyName := tmpBody.Name()
+	if _, err := io.Copy(tmpBody, body); err != nil {
+		tmpBody.Close()
+		os.Remove(tmpBodyName)
+		return err
+	}
+	if err := tmpBody.Close(); err != nil {
+		os.Remove(tmpBodyName)
+		return err
+	}
+
+	metaBytes, err := json.Marshal(localMeta{StatusCode: meta.StatusCode, Header: meta.Header})
+	if err != nil {
+		os.Remove(tmpBodyName)
+		return err
+	}
+
+	metaPath := bodyPath + ".meta.json"
+	tmpMeta, err := os.CreateTemp(filepath.Dir(metaPath), filepath.Base(metaPath)+".*.tmp")
+	if err != nil {
+		os.Remove(tmpBodyName)
+		return err
+	}
+	tmpMetaName := tmpMeta.Name()
+	if _, err := tmpMeta.Write(metaBytes); err != nil {
+		tmpMeta.Close()
+		os.Remove(tmpMetaName)
+		os.Remove(tmpBodyName)
+		return err
+	}
+	if err := tmpMeta.Close(); err != nil {
+		os.Remove(tmpMetaName)
+		os.Remove(tmpBodyName)
+		return err
+	}
+
+	// Rename the body into place before the meta sidecar: since Get reads
+	// the meta before opening the body, a reader racing this Put sees the
+	// fully-old pair, the fully-new pair, or old meta with the new body.
+	// That one transient mismatch fails safe, since net/http
+	// truncates a response at the declared Content-Length rather than
+	// under-delivering past it - the other order could pair a new,
+	// larger Content-Length with the still-old, shorter body and hang the
+	// client waiting for bytes that never arrive.
+	if err := os.Rename(tmpBodyName, bodyPath); err != nil {
+		os.Remove(tmpMetaName)
+		os.Remove(tmpBodyName)
+		return err
+	}
+	return os.Rename(tmpMetaName, metaPath)
+}
+
+func (s *localBlobStore) Touch(name string) error {
+	bodyPath, err := s.bodyPath(name)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(bodyPath, now, now)
+}
+
+func (s *localBlobStore) List(prefix string) ([]Entry, error) {
+	base, err := s.bodyPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	err = filepath.Walk(base, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(p, ".meta.json") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, Entry{
+			Name:    "/" + filepath.ToSlash(rel),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *localBlobStore) Delete(name string) error {
+	bodyPath, err := s.bodyPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(bodyPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(bodyPath + ".meta.json"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+type localBlob struct {
+	f    *os.File
+	size int64
+}
+
+func (b *localBlob) ReadAt(p []byte, off int64) (int, error) { return b.f.ReadAt(p, off) }
+func (b *localBlob) Size() int64                             { return b.size }
+func (b *localBlob) Close() error                            { return b.f.Close() }
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3BlobStore stores objects in an S3-compatible bucket, authenticating
+// requests with AWS SigV4 from the standard AWS_* environment variables.
+// Headers and status code are stored as object user metadata (under an
+// "X-Amz-Meta-Cra-" prefix) alongside the body as the object payload, so
+// that multiple proxy replicas can share one cache.
+//
+// CRA_PROXY_S3_ENDPOINT can point this at any S3-compatible endpoint,
+// including GCS's S3 interoperability API, instead of AWS.
+type s3BlobStore struct {
+	client          *http.Client
+	endpoint        string
+	bucket          string
+	prefix          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+func newS3BlobStore(backend string) (*s3BlobStore, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	region := firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint := os.Getenv("CRA_PROXY_S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	return &s3BlobStore{
+		client:          &http.Client{Timeout: time.Second * 30},
+		endpoint:        strings.TrimSuffix(endpoint, "/"),
+		bucket:          u.Host,
+		prefix:          strings.Trim(u.Path, "/"),
+		region:          region,
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *s3BlobStore) objectKey(name string) string {
+	trimmed := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if s.prefix == "" {
+		return trimmed
+	}
+	return s.prefix + "/" + trimmed
+}
+
+func (s *s3BlobStore) Get(name string) (Blob, Meta, error) {
+	key := s.objectKey(name)
+	res, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, Meta{}, fmt.Errorf("%s: %w", name, ErrBlobNotExist)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, Meta{}, fmt.Errorf("s3: GET %s: %s", key, res.Status)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+
+	return &s3Blob{data: data}, metaFromS3Header(res.Header, int64(len(data))), nil
+}
+
+func (s *s3BlobStore) Stat(name string) (Meta, error) {
+	key := s.objectKey(name)
+	res, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return Meta{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return Meta{}, fmt.Errorf("%s: %w", name, ErrBlobNotExist)
+	}
+	if res.StatusCode != http.StatusOK {
+		return Meta{}, fmt.Errorf("s3: HEAD %s: %s", key, res.Status)
+	}
+
+	size, _ := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	return metaFromS3Header(res.Header, size), nil
+}
+
+func (s *s3BlobStore) Put(name string, meta Meta, body io.Reader) error {
+	key := s.objectKey(name)
+	header := http.Header{}
+	encodeS3Meta(header, meta)
+
+	res, err := s.do(http.MethodPut, key, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3: PUT %s: %s", key, res.Status)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Touch(name string) error {
+	key := s.objectKey(name)
+	meta, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+s.bucket+"/"+key)
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	encodeS3Meta(header, meta)
+
+	res, err := s.do(http.MethodPut, key, header, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3: touch %s: %s", key, res.Status)
+	}
+	return nil
+}
+
+// s3ListResult is the subset of a ListObjectsV2 response we need.
+type s3ListResult struct {
+	Contents              []s3ListEntry `xml:"Contents"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	NextContinuationToken string        `xml:"NextContinuationToken"`
+}
+
+type s3ListEntry struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+}
+
+func (s *s3BlobStore) List(prefix string) ([]Entry, error) {
+	keyPrefix := s.objectKey(prefix)
+	if trimmed := strings.Trim(prefix, "/"); trimmed != "" {
+		// Force a directory boundary so listing "v1" doesn't also match
+		// "v10/...": objectKey gives us no separator between them.
+		keyPrefix += "/"
+	}
+
+	var entries []Entry
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", keyPrefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, s.endpoint+"/"+s.bucket, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.URL.RawQuery = query.Encode()
+		s.sign(req, nil)
+
+		res, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("s3: LIST %s: %s", keyPrefix, res.Status)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			modTime, _ := time.Parse(time.RFC3339, c.LastModified)
+			entries = append(entries, Entry{
+				Name:    "/" + strings.TrimPrefix(strings.TrimPrefix(c.Key, s.prefix), "/"),
+				Size:    c.Size,
+				ModTime: modTime,
+			})
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return entries, nil
+}
+
+func (s *s3BlobStore) Delete(name string) error {
+	key := s.objectKey(name)
+	res, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3: DELETE %s: %s", key, res.Status)
+	}
+	return nil
+}
+
+// s3Blob holds a GET response body entirely in memory, which is simple and
+// fine for the JS/CSS/HTML bundles this proxy serves, and gives us the
+// io.ReaderAt Blob needs without extra ranged requests to S3.
+type s3Blob struct {
+	data []byte
+}
+
+func (b *s3Blob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *s3Blob) Size() int64  { return int64(len(b.data)) }
+func (b *s3Blob) Close() error { return nil }
+
+const s3MetaHeaderPrefix = "X-Amz-Meta-Cra-Hdr-"
+
+func encodeS3Meta(header http.Header, meta Meta) {
+	header.Set("X-Amz-Meta-Cra-Status", strconv.Itoa(meta.StatusCode))
+	header.Set("X-Amz-Meta-Cra-Cached-At", time.Now().UTC().Format(time.RFC3339))
+	for name, values := range meta.Header {
+		header.Set(s3MetaHeaderPrefix+name, strings.Join(values, ", "))
+	}
+}
+
+func metaFromS3Header(header http.Header, size int64) Meta {
+	meta := Meta{Header: http.Header{}, Size: size, StatusCode: http.StatusOK}
+
+	for name, values := range header {
+		canon := http.CanonicalHeaderKey(name)
+		if !strings.HasPrefix(canon, s3MetaHeaderPrefix) {
+			continue
+		}
+		meta.Header.Set(strings.TrimPrefix(canon, s3MetaHeaderPrefix), strings.Join(values, ", "))
+	}
+
+	if status, err := strconv.Atoi(header.Get("X-Amz-Meta-Cra-Status")); err == nil {
+		meta.StatusCode = status
+	}
+
+	if cachedAt, err := time.Parse(time.RFC3339, header.Get("X-Amz-Meta-Cra-Cached-At")); err == nil {
+		meta.ModTime = cachedAt
+	} else if lastMod, err := time.Parse(http.TimeFormat, header.Get("Last-Modified")); err == nil {
+		meta.ModTime = lastMod
+	}
+
+	return meta
+}
+
+// do issues a SigV4-signed request for key against the bucket, with an
+// optional body (read fully into memory so it can both be hashed for the
+// signature and retried by http.Client's transport).
+func (s *s3BlobStore) do(method, key string, header http.Header, body io.Reader) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = b
+	}
+
+	req, err := http.NewRequest(method, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	s.sign(req, payload)
+
+	return s.client.Do(req)
+}
+
+// sign adds the headers and Authorization needed for AWS Signature
+// Version 4, per
+// https://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
+func (s *s3BlobStore) sign(req *http.Request, payload []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signedHeaders, canonicalHeaders := canonicalS3Headers(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalS3Query(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	credentialScope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		credentialScope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(dateStamp), stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, credentialScope, signedHeaders, signature,
+	))
+}
+
+func (s *s3BlobStore) signingKey(dateStamp string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+s.secretAccessKey), dateStamp)
+	kRegion := hmacSHA256(kDate, s.region)
+	kService := hmacSHA256(kRegion, "s3")
+	return hmacSHA256(kService, "aws4_request")
+}
+
+func canonicalS3Headers(req *http.Request) (signedHeaders, canonicalHeaders string) {
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+	}
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canon strings.Builder
+	for _, name := range names {
+		canon.WriteString(name)
+		canon.WriteByte(':')
+		canon.WriteString(strings.TrimSpace(headers[name]))
+		canon.WriteByte('\n')
+	}
+
+	return strings.Join(names, ";"), canon.String()
+}
+
+func canonicalS3Query(values url.Values) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(values))
+	for _, k := range keys {
+		vals := append([]string(nil), values[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
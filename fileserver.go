@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fileServer struct {
+	store    BlobStore
+	sources  []Source
+	client   *http.Client
+	inflight *inflightRegistry
+
+	// scratchDir holds the `.partial` files in-progress fetches are
+	// staged to before being committed to store - this is local disk even
+	// when store is remote, since live readers tail it directly.
+	scratchDir string
+
+	// ttl is how long a cached default-version entry may be served before
+	// it is revalidated against the source. Zero disables TTL checking for
+	// entries no ttlOverrides suffix matches, so those are served until
+	// evicted some other way.
+	ttl time.Duration
+	// ttlOverrides lets specific path suffixes (e.g. "index.html") use a
+	// different TTL than the default; the first matching suffix wins.
+	ttlOverrides []ttlOverride
+	// defaultVersion reports the currently active rollout (one or more
+	// weighted versions), used to decide whether a cached entry lives
+	// under an immutable version prefix. Entries under any other version
+	// are never revalidated; every entry under the active default
+	// version(s) is subject to ttl (or its ttlOverrides match).
+	defaultVersion func() []VersionWeight
+}
+
+// TTLConfig is the JSON shape for CRA_PROXY_CACHE_TTL_CONFIG: a list of
+// path suffix to TTL (as a time.ParseDuration string) overrides.
+type TTLConfig struct {
+	Suffix string `json:"suffix"`
+	TTL    string `json:"ttl"`
+}
+
+type ttlOverride struct {
+	suffix string
+	ttl    time.Duration
+}
+
+func (fs fileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("X-Cache", "hit")
+	name := path.Clean(req.URL.Path)
+	err := fs.tryServeFile(rw, req, name)
+	if errors.Is(err, ErrBlobNotExist) {
+		rw.Header().Set("X-Cache", "miss")
+		if err := fs.doCacheFetch(rw, req, name); err != nil {
+			doError(rw, req, err)
+			return
+		}
+	} else if err != nil {
+		doError(rw, req, err)
+		return
+	}
+}
+
+// inflightRegistry tracks upstream fetches that are currently in progress,
+// keyed by cache name, so that concurrent requests for the same object
+// share a single upstream fetch instead of each issuing their own. It is
+// held by pointer so that copies of fileServer (it is passed around by
+// value) all see the same set of in-progress fetches.
+type inflightRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*inflightFetch
+}
+
+// inflightKind distinguishes the two uses of inflightFetch sharing
+// fs.inflight.entries, so a fetch-joiner can never be handed a
+// revalidation's entry (which never populates status/header/partialPath,
+// since revalidateOnce's joiners just wait for a result rather than
+// streaming one).
+type inflightKind int
+
+const (
+	inflightKindFetch inflightKind = iota
+	inflightKindRevalidate
+)
+
+// inflightFetch is the shared state for a single in-progress cold-miss
+// fetch or revalidation. A cold-miss fetcher (kind == inflightKindFetch)
+// writes the response body to a `.partial` file and broadcasts on cond as
+// bytes are written; live readers tail the same file via cond.Wait instead
+// of blocking until the fetch completes. A revalidation (kind ==
+// inflightKindRevalidate) only ever sets done/err - it has no body for a
+// joiner to stream, so joiners must wait for it rather than call
+// serveLiveReader on it.
+type inflightFetch struct {
+	kind inflightKind
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	status      int
+	header      http.Header
+	partialPath string
+	size        int64
+	done        bool
+	err         error
+}
+
+func (fs fileServer) doCacheFetch(rw http.ResponseWriter, req *http.Request, name string) error {
+	fs.inflight.mu.Lock()
+	if entry, ok := fs.inflight.entries[name]; ok {
+		fs.inflight.mu.Unlock()
+		if entry.kind != inflightKindFetch {
+			// Only a revalidation is in flight for name, not a streamable
+			// cold-miss fetch - e.g. the blob was evicted out from under it
+			// by DELETE /cache/{version}. A revalidation entry never sets
+			// status/header/partialPath, so serveLiveReader would just
+			// wait for done and return a (usually nil) err having written
+			// nothing. Wait for it instead, then handle this request as if
+			// arriving fresh.
+			fs.waitForInflight(entry)
+			if err := fs.tryServeFile(rw, req, name); !errors.Is(err, ErrBlobNotExist) {
+				return err
+			}
+			return fs.doCacheFetch(rw, req, name)
+		}
+		return fs.serveLiveReader(rw, entry)
+	}
+
+	entry := &inflightFetch{kind: inflightKindFetch}
+	entry.cond = sync.NewCond(&entry.mu)
+	fs.inflight.entries[name] = entry
+	fs.inflight.mu.Unlock()
+
+	fs.runFetch(name, entry)
+
+	fs.inflight.mu.Lock()
+	delete(fs.inflight.entries, name)
+	fs.inflight.mu.Unlock()
+
+	if entry.err != nil {
+		return entry.err
+	}
+	return fs.tryServeFile(rw, req, name)
+}
+
+// runFetch performs the single upstream fetch for name, staging the
+// response body in a `.partial` file under scratchDir and committing it to
+// store once the upstream body is fully read. Progress (and the terminal
+// error, if any) is recorded on entry and broadcast so that doCacheFetch
+// and any concurrent serveLiveReader calls waiting on entry.cond wake up.
+func (fs fileServer) runFetch(name string, entry *inflightFetch) {
+	finish := func(err error) {
+		entry.mu.Lock()
+		entry.err = err
+		entry.done = true
+		entry.cond.Broadcast()
+		entry.mu.Unlock()
+	}
+
+	res, err := fetchFromSources(fs.client, fs.sources, name, nil)
+	if err != nil {
+		finish(err)
+		return
+	}
+	defer res.Body.Close()
+
+	os.MkdirAll(fs.scratchDir, os.FileMode(0770))
+	scratch, err := os.CreateTemp(fs.scratchDir, "fetch-*.partial")
+	if err != nil {
+		finish(err)
+		return
+	}
+	entry.partialPath = scratch.Name()
+
+	abort := func(err error) {
+		scratch.Close()
+		os.Remove(entry.partialPath)
+		finish(err)
+	}
+
+	entry.mu.Lock()
+	entry.status = res.StatusCode
+	entry.header = res.Header
+	entry.cond.Broadcast()
+	entry.mu.Unlock()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := scratch.Write(buf[:n]); werr != nil {
+				abort(werr)
+				return
+			}
+			entry.mu.Lock()
+			entry.size += int64(n)
+			entry.cond.Broadcast()
+			entry.mu.Unlock()
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			abort(rerr)
+			return
+		}
+	}
+
+	if err := scratch.Close(); err != nil {
+		os.Remove(entry.partialPath)
+		finish(err)
+		return
+	}
+
+	body, err := os.Open(entry.partialPath)
+	if err != nil {
+		os.Remove(entry.partialPath)
+		finish(err)
+		return
+	}
+	putErr := fs.store.Put(name, Meta{StatusCode: res.StatusCode, Header: res.Header}, body)
+	body.Close()
+	os.Remove(entry.partialPath)
+
+	finish(putErr)
+}
+
+// serveLiveReader streams a response for an upstream fetch that's already
+// in progress, tailing the `.partial` file the fetcher in runFetch is
+// writing to rather than waiting for it to finish.
+func (fs fileServer) serveLiveReader(rw http.ResponseWriter, entry *inflightFetch) error {
+	entry.mu.Lock()
+	for entry.status == 0 && !entry.done {
+		entry.cond.Wait()
+	}
+	if entry.status == 0 {
+		err := entry.err
+		entry.mu.Unlock()
+		return err
+	}
+	status, header := entry.status, entry.header
+	entry.mu.Unlock()
+
+	rwHeader := rw.Header()
+	for key, vals := range header {
+		for _, val := range vals {
+			rwHeader.Add(key, val)
+		}
+	}
+	rw.WriteHeader(status)
+
+	f, err := os.Open(entry.partialPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 32*1024)
+	var offset int64
+	for {
+		entry.mu.Lock()
+		for entry.size <= offset && !entry.done {
+			entry.cond.Wait()
+		}
+		size, done, fetchErr := entry.size, entry.done, entry.err
+		entry.mu.Unlock()
+
+		for offset < size {
+			want := size - offset
+			if want > int64(len(buf)) {
+				want = int64(len(buf))
+			}
+			n, rerr := f.ReadAt(buf[:want], offset)
+			if n > 0 {
+				if _, werr := rw.Write(buf[:n]); werr != nil {
+					return werr
+				}
+				offset += int64(n)
+			}
+			if rerr != nil && rerr != io.EOF {
+				return rerr
+			}
+			if n == 0 {
+				break
+			}
+		}
+
+		if done {
+			return fetchErr
+		}
+	}
+}
+
+func (fs fileServer) tryServeFile(rw http.ResponseWriter, req *http.Request, name string) error {
+	blob, meta, err := fs.store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if fs.needsRevalidation(name, meta.ModTime) {
+		if revalErr := fs.revalidateOnce(name, meta.Header); revalErr == nil {
+			// The cache entry was refreshed (or just had its timestamp
+			// bumped on a 304) in place - serve the new copy.
+			return fs.tryServeFile(rw, req, name)
+		}
+		// Revalidation failed (network error, upstream down, ...) - serve
+		// the stale copy we already have rather than failing the request.
+		rw.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+
+	rwHeader := rw.Header()
+	for key, vals := range meta.Header {
+		for _, val := range vals {
+			rwHeader.Add(key, val)
+		}
+	}
+
+	rw.WriteHeader(meta.StatusCode)
+	_, err = io.Copy(rw, io.NewSectionReader(blob, 0, blob.Size()))
+	return err
+}
+
+// needsRevalidation reports whether the cached entry at name, last written
+// at modTime, is stale enough to revalidate. Versioned paths other than
+// the current default version are immutable and are never revalidated.
+func (fs fileServer) needsRevalidation(name string, modTime time.Time) bool {
+	if fs.isImmutable(name) {
+		return false
+	}
+	ttl := fs.ttlFor(name)
+	if ttl <= 0 {
+		return false
+	}
+	return time.Since(modTime) > ttl
+}
+
+// isImmutable reports whether name lives under a version prefix that isn't
+// one of the currently active default versions.
+func (fs fileServer) isImmutable(name string) bool {
+	if fs.defaultVersion == nil {
+		return false
+	}
+	version, _, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	for _, w := range fs.defaultVersion() {
+		if w.Version == version {
+			return false
+		}
+	}
+	return true
+}
+
+// ttlFor returns the TTL that applies to name: the first matching suffix
+// override, or fs.ttl if none match.
+func (fs fileServer) ttlFor(name string) time.Duration {
+	for _, override := range fs.ttlOverrides {
+		if strings.HasSuffix(name, override.suffix) {
+			return override.ttl
+		}
+	}
+	return fs.ttl
+}
+
+// revalidateOnce runs revalidate for name through the same inflight
+// registry cold misses use, so concurrent requests for an expired entry
+// share a single revalidation instead of each independently calling
+// store.Put/Touch for the same name - which, run concurrently, can pair the
+// body from one fetch with the Meta from another. Joiners simply wait for
+// the in-progress revalidation's result rather than streaming it, since the
+// stale cached entry is already servable in the meantime.
+func (fs fileServer) revalidateOnce(name string, cachedHeader http.Header) error {
+	fs.inflight.mu.Lock()
+	if entry, ok := fs.inflight.entries[name]; ok {
+		fs.inflight.mu.Unlock()
+		return fs.waitForInflight(entry)
+	}
+
+	entry := &inflightFetch{kind: inflightKindRevalidate}
+	entry.cond = sync.NewCond(&entry.mu)
+	fs.inflight.entries[name] = entry
+	fs.inflight.mu.Unlock()
+
+	err := fs.revalidate(name, cachedHeader)
+
+	entry.mu.Lock()
+	entry.err = err
+	entry.done = true
+	entry.cond.Broadcast()
+	entry.mu.Unlock()
+
+	fs.inflight.mu.Lock()
+	delete(fs.inflight.entries, name)
+	fs.inflight.mu.Unlock()
+
+	return err
+}
+
+// waitForInflight blocks until entry is done, without attempting to stream
+// it - used by revalidateOnce joiners, which have no partial body to tail.
+func (fs fileServer) waitForInflight(entry *inflightFetch) error {
+	entry.mu.Lock()
+	for !entry.done {
+		entry.cond.Wait()
+	}
+	err := entry.err
+	entry.mu.Unlock()
+	return err
+}
+
+// revalidate issues a conditional GET for name against the source, using
+// the ETag/Last-Modified of the cached response. A 304 just bumps the
+// cache entry's timestamp; any other response replaces the cached body and
+// headers, the same as a fresh fetch.
+func (fs fileServer) revalidate(name string, cachedHeader http.Header) error {
+	res, err := fetchFromSources(fs.client, fs.sources, name, func(req *http.Request) {
+		if etag := cachedHeader.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cachedHeader.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return fs.store.Touch(name)
+	}
+
+	return fs.store.Put(name, Meta{StatusCode: res.StatusCode, Header: res.Header}, res.Body)
+}
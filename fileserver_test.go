@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsImmutable(t *testing.T) {
+	fs := fileServer{
+		defaultVersion: func() []VersionWeight {
+			return []VersionWeight{{Version: "v1", Weight: 90}, {Version: "v2", Weight: 10}}
+		},
+	}
+
+	cases := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{name: "active version v1", path: "/v1/index.html", want: false},
+		{name: "active version v2", path: "/v2/static/main.js", want: false},
+		{name: "old version", path: "/v0/index.html", want: true},
+		{name: "no leading slash", path: "v1/index.html", want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := fs.isImmutable(c.path); got != c.want {
+				t.Errorf("isImmutable(%q) = %v, want %v", c.path, got, c.want)
+			}
+		})
+	}
+}
+
+func TestIsImmutableNoDefaultVersion(t *testing.T) {
+	fs := fileServer{}
+	if fs.isImmutable("/v1/index.html") {
+		t.Error("isImmutable with no defaultVersion func should be false (every entry is then subject to the TTL)")
+	}
+}
+
+func TestTTLFor(t *testing.T) {
+	fs := fileServer{
+		ttl: time.Minute,
+		ttlOverrides: []ttlOverride{
+			{suffix: "index.html", ttl: time.Second * 5},
+		},
+	}
+
+	if got := fs.ttlFor("/v1/index.html"); got != time.Second*5 {
+		t.Errorf("ttlFor(index.html) = %s, want the override", got)
+	}
+	if got := fs.ttlFor("/v1/static/main.js"); got != time.Minute {
+		t.Errorf("ttlFor(main.js) = %s, want the default", got)
+	}
+}
+
+func TestNeedsRevalidation(t *testing.T) {
+	fs := fileServer{
+		ttl: time.Minute,
+		defaultVersion: func() []VersionWeight {
+			return []VersionWeight{{Version: "v1", Weight: 100}}
+		},
+	}
+
+	if fs.needsRevalidation("/v1/index.html", time.Now()) {
+		t.Error("a freshly-written entry should not need revalidation")
+	}
+	if !fs.needsRevalidation("/v1/index.html", time.Now().Add(-time.Hour)) {
+		t.Error("an entry past its TTL should need revalidation")
+	}
+	if fs.needsRevalidation("/v0/index.html", time.Now().Add(-time.Hour)) {
+		t.Error("an immutable (non-default) version should never need revalidation")
+	}
+}
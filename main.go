@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,7 +11,6 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -23,38 +20,118 @@ import (
 const EnvVarPrefix = "CRA_PROXY_"
 
 func main() {
-	sourceURL, err := url.Parse(os.Getenv(EnvVarPrefix + "SOURCE"))
+	sources, err := loadSources()
 	if err != nil {
-		log.Fatalf("Invalid url in $SOURCE_URL: %s", err.Error())
+		log.Fatalf("Configuring sources: %s", err.Error())
 	}
 
 	cacheDir := os.Getenv(EnvVarPrefix + "CACHE_DIR")
+	cacheBackend := os.Getenv(EnvVarPrefix + "CACHE_BACKEND")
 	bindAddress := os.Getenv(EnvVarPrefix + "BIND")
 	defaultVersion := os.Getenv(EnvVarPrefix + "DEFAULT_VERSION")
 
+	backend := cacheBackend
+	if backend == "" {
+		backend = cacheDir
+	}
+	store, err := NewBlobStore(backend)
+	if err != nil {
+		log.Fatalf("Configuring $%sCACHE_BACKEND: %s", EnvVarPrefix, err.Error())
+	}
+
+	scratchDir := cacheDir
+	if scratchDir == "" {
+		scratchDir = os.TempDir()
+	}
+
+	var ttl time.Duration
+	if ttlEnv := os.Getenv(EnvVarPrefix + "CACHE_TTL"); ttlEnv != "" {
+		ttl, err = time.ParseDuration(ttlEnv)
+		if err != nil {
+			log.Fatalf("Invalid $%sCACHE_TTL: %s", EnvVarPrefix, err.Error())
+		}
+	}
+
+	var ttlOverrides []ttlOverride
+	if ttlConfigFile := os.Getenv(EnvVarPrefix + "CACHE_TTL_CONFIG"); ttlConfigFile != "" {
+		ttlConfig := []TTLConfig{}
+		if err := loadJSONFile(ttlConfigFile, &ttlConfig); err != nil {
+			log.Fatalf("Loading Cache TTL Config %s", err.Error())
+		}
+		for _, entry := range ttlConfig {
+			d, err := time.ParseDuration(entry.TTL)
+			if err != nil {
+				log.Fatalf("Invalid ttl %q for suffix %q: %s", entry.TTL, entry.Suffix, err.Error())
+			}
+			ttlOverrides = append(ttlOverrides, ttlOverride{suffix: entry.Suffix, ttl: d})
+		}
+	}
+
 	var handler http.Handler
 	sourceClient := &http.Client{
 		Timeout: time.Second * 10,
 	}
 
-	handler = fileServer{
-		root:      http.Dir(cacheDir),
-		sourceURL: sourceURL,
-		client:    sourceClient,
+	defaultVersionFile := os.Getenv(EnvVarPrefix + "DEFAULT_VERSION_FILE")
+	if defaultVersionFile == "" {
+		defaultVersionFile = "/default-version.txt"
 	}
 
-	var defaultVersionFunc func() string
+	var defaultVersionFunc func() []VersionWeight
+	var refreshDefaultVersion func()
 	if defaultVersion != "" {
-		defaultVersionFunc = func() string {
-			return defaultVersion
+		defaultVersionFunc = func() []VersionWeight {
+			return []VersionWeight{{Version: defaultVersion, Weight: 100}}
 		}
 	} else {
-		defaultVersionFunc, err = defaultVersionPoller(sourceClient, sourceURL.String()+"/default-version.txt")
+		onDefaultVersionChange := func(old, newVersions []VersionWeight) {
+			oldVersions := map[string]bool{}
+			for _, w := range old {
+				oldVersions[w.Version] = true
+			}
+			for _, w := range newVersions {
+				if oldVersions[w.Version] {
+					continue
+				}
+				go func(version string) {
+					if err := prefetchVersion(sourceClient, sources, store, version); err != nil {
+						log.Printf("Prefetching %s: %s", version, err.Error())
+					}
+				}(w.Version)
+			}
+		}
+
+		defaultVersionFunc, refreshDefaultVersion, err = defaultVersionPoller(sourceClient, sources, defaultVersionFile, onDefaultVersionChange)
 		if err != nil {
 			log.Fatalf("Fetching default version: %s", err.Error())
 		}
 	}
 
+	if adminBind := os.Getenv(EnvVarPrefix + "ADMIN_BIND"); adminBind != "" {
+		adminMux := AdminMux(AdminConfig{
+			Store:          store,
+			Sources:        sources,
+			Client:         sourceClient,
+			RefreshDefault: refreshDefaultVersion,
+		})
+		go func() {
+			if err := http.ListenAndServe(adminBind, adminMux); err != nil {
+				log.Fatal(err.Error())
+			}
+		}()
+	}
+
+	handler = fileServer{
+		store:          store,
+		sources:        sources,
+		client:         sourceClient,
+		inflight:       &inflightRegistry{entries: map[string]*inflightFetch{}},
+		scratchDir:     scratchDir,
+		ttl:            ttl,
+		ttlOverrides:   ttlOverrides,
+		defaultVersion: defaultVersionFunc,
+	}
+
 	handler = VersionSwitch(defaultVersionFunc)(handler)
 	handler = AppRewrite(handler)
 	handler = Logger(handler)
@@ -81,143 +158,156 @@ func loadJSONFile(filename string, into interface{}) error {
 	return json.NewDecoder(f).Decode(into)
 }
 
-func defaultVersionPoller(client *http.Client, url string) (func() string, error) {
+// loadSources builds the list of upstream sources to fetch cache misses
+// from, preferring the most specific configuration available:
+// $CRA_PROXY_SOURCES_CONFIG (a JSON file of SourceConfig), then
+// $CRA_PROXY_SOURCES (a GOPROXY-style comma/pipe separated list), falling
+// back to the single $CRA_PROXY_SOURCE URL for backward compatibility.
+func loadSources() ([]Source, error) {
+	if configFile := os.Getenv(EnvVarPrefix + "SOURCES_CONFIG"); configFile != "" {
+		var configs []SourceConfig
+		if err := loadJSONFile(configFile, &configs); err != nil {
+			return nil, err
+		}
+		sources := make([]Source, 0, len(configs))
+		for _, cfg := range configs {
+			u, err := url.Parse(cfg.URL)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, Source{URL: u, FallBackOnError: cfg.FallBackOnError})
+		}
+		return sources, nil
+	}
+
+	if spec := os.Getenv(EnvVarPrefix + "SOURCES"); spec != "" {
+		return parseSourceList(spec)
+	}
+
+	u, err := url.Parse(os.Getenv(EnvVarPrefix + "SOURCE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid url in $%sSOURCE: %w", EnvVarPrefix, err)
+	}
+	return []Source{{URL: u}}, nil
+}
+
+// defaultVersionPoller fetches the default version(s) from path, tried
+// against each source in turn, and keeps them refreshed in the background.
+// Unlike a cache miss, a poll falls through to the next source on a
+// connection error, 404/410 or 5xx whatever the source's FallBackOnError,
+// so it only fails (leaving the previous value in place) when every source
+// fails, or when a source answers with some other non-200 status.
+//
+// path ending in ".json" is taken to be a weighted rollout: a JSON array of
+// VersionWeight, used by VersionSwitch to pick a version per client for
+// staged rollouts and canaries. Any other path is read as a single version
+// name (given full weight), for backward compatibility.
+//
+// onChange, if non-nil, is called from the background poll loop (never for
+// the initial fetch) whenever the versions served differ from the previous
+// poll, so callers can react to a deploy - e.g. prefetching the new
+// version's entry point. The returned refresh func forces an immediate
+// poll rather than waiting for the next tick, for the admin API's
+// POST /refresh-default.
+//
+// Each poll rotates its starting source, so repeated polls spread load
+// across every configured source rather than always hitting sources[0]
+// while it stays healthy.
+func defaultVersionPoller(client *http.Client, sources []Source, path string, onChange func(old, new []VersionWeight)) (func() []VersionWeight, func(), error) {
 	mutex := sync.RWMutex{}
+	refresh := make(chan struct{}, 1)
+
+	nextSource := 0
+	fetchVersions := func() ([]VersionWeight, error) {
+		rotated := rotateSources(sources, nextSource)
+		for i := range rotated {
+			rotated[i].FallBackOnError = true
+		}
+		if len(sources) > 0 {
+			nextSource = (nextSource + 1) % len(sources)
+		}
 
-	fetchVersion := func() (string, error) {
-		res, err := client.Get(url)
+		res, err := fetchFromSources(client, rotated, path, nil)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		defer res.Body.Close()
 		if res.StatusCode != 200 {
-			return "", fmt.Errorf("HTTP %s getting version", res.Status)
+			return nil, fmt.Errorf("HTTP %s getting version", res.Status)
 		}
-		versionBytes, err := ioutil.ReadAll(res.Body)
+		body, err := ioutil.ReadAll(res.Body)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+
+		if strings.HasSuffix(path, ".json") {
+			var weights []VersionWeight
+			if err := json.Unmarshal(body, &weights); err != nil {
+				return nil, err
+			}
+			return weights, nil
 		}
-		return strings.TrimSpace(string(versionBytes)), nil
+
+		return []VersionWeight{{Version: strings.TrimSpace(string(body)), Weight: 100}}, nil
 	}
 
-	defaultVersion, err := fetchVersion()
+	versions, err := fetchVersions()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	log.Printf("Default Version from source: '%s'", defaultVersion)
+	log.Printf("Default Version(s) from source: %v", versions)
 
 	go func() {
+		delay := time.Minute
 		for {
-			newVersion, err := fetchVersion()
+			select {
+			case <-refresh:
+			case <-time.After(delay):
+			}
+
+			newVersions, err := fetchVersions()
 			if err != nil {
 				log.Printf(err.Error())
-				time.Sleep(time.Second * 5)
+				delay = time.Second * 5
 				continue
 			}
+			delay = time.Minute
 
 			mutex.Lock()
-			if defaultVersion != newVersion {
-				log.Printf("Updating default version to '%s'", newVersion)
-			}
-			defaultVersion = newVersion
+			oldVersions := versions
+			versions = newVersions
 			mutex.Unlock()
-			time.Sleep(time.Minute)
+
+			if onChange != nil && !sameVersionWeights(oldVersions, newVersions) {
+				onChange(oldVersions, newVersions)
+			}
 		}
 	}()
 
-	return func() string {
+	get := func() []VersionWeight {
 		mutex.RLock()
 		defer mutex.RUnlock()
-		return defaultVersion
-	}, nil
-}
-
-type fileServer struct {
-	root      http.Dir
-	sourceURL *url.URL
-	client    *http.Client
-}
-
-func (fs fileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	rw.Header().Set("X-Cache", "hit")
-	name := path.Clean(req.URL.Path)
-	err := fs.tryServeFile(rw, req, name)
-	if os.IsNotExist(err) {
-		rw.Header().Set("X-Cache", "miss")
-		if err := fs.doCacheFetch(rw, req, name); err != nil {
-			doError(rw, req, err)
-			return
-		}
-		if err := fs.tryServeFile(rw, req, name); err != nil {
-			doError(rw, req, err)
-			return
-		}
-	} else if err != nil {
-		doError(rw, req, err)
-		return
-	}
-}
-
-func (fs fileServer) doCacheFetch(rw http.ResponseWriter, req *http.Request, name string) error {
-	// TODO: Exclusive Lock - Will multiple concurrent fetches corrupt the file
-	// or error out?
-
-	urlOut := &url.URL{
-		Path:   path.Join(fs.sourceURL.Path, name),
-		Scheme: fs.sourceURL.Scheme,
-		Host:   fs.sourceURL.Host,
-	}
-
-	res, err := fs.client.Get(urlOut.String())
-	if err != nil {
-		return err
-	}
-
-	//  Taken from http.Dir.Open
-	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
-		return errors.New("http: invalid character in file path")
+		return versions
 	}
-	fullName := filepath.Join(string(fs.root), filepath.FromSlash(path.Clean("/"+name)))
-	// Done with http.Dir.Open clone
-
-	os.MkdirAll(filepath.Dir(fullName), os.FileMode(0770))
-	cacheFile, err := os.Create(fullName)
-	if err != nil {
-		return err
+	trigger := func() {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
 	}
-	defer cacheFile.Close()
-
-	return res.Write(cacheFile)
-
+	return get, trigger, nil
 }
 
-func (fs fileServer) tryServeFile(rw http.ResponseWriter, req *http.Request, name string) error {
-	// http.Dir.Open ensures the file is rooted at root.
-	f, err := fs.root.Open(name)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	buffered := bufio.NewReader(f)
-	parsedResponse, err := http.ReadResponse(buffered, nil)
-	if err != nil {
-		return err
+func sameVersionWeights(a, b []VersionWeight) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	defer parsedResponse.Body.Close()
-
-	// TODO: Discard and delete if cache is expired.
-
-	rwHeader := rw.Header()
-	for key, vals := range parsedResponse.Header {
-		for _, val := range vals {
-			rwHeader.Add(key, val)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
-
-	rw.WriteHeader(parsedResponse.StatusCode)
-	_, err = io.Copy(rw, parsedResponse.Body)
-	return err
+	return true
 }
 
 const VERSION_COOKIE_NAME = "version-override"
@@ -229,7 +319,13 @@ var reVersionUnsafe = regexp.MustCompile(`[^a-zA-Z0-9]`)
 // cookie. When the querystring parameter is set, the cookie is sent with the
 // response so that requests for resources in HTML pages (css, images etc) will
 // also get the correct prefix.
-func VersionSwitch(defaultVersion func() string) func(http.Handler) http.Handler {
+//
+// With no querystring or cookie and more than one weighted default version,
+// the version is chosen by weighted rollout (see selectRolloutVersion) and
+// pinned into the version cookie, so the client keeps getting the same
+// version for the cookie's lifetime rather than being re-rolled on every
+// request. A single default version is used as is, with no cookie set.
+func VersionSwitch(defaultVersions func() []VersionWeight) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 
@@ -264,8 +360,27 @@ func VersionSwitch(defaultVersion func() string) func(http.Handler) http.Handler
 				// Don't cache versioned resources (Cookies are not considered
 				// by browsers when looking up cached responses)
 				rw.Header().Set("Cache-Control", "no-store")
-			} else {
-				version = defaultVersion()
+			} else if weights := defaultVersions(); len(weights) > 1 {
+				// An actual weighted rollout is in effect - pick a version
+				// for this client and pin it in the version cookie so they
+				// keep getting the same one for the cookie's lifetime,
+				// rather than being re-rolled on every request.
+				version = selectRolloutVersion(rw, req, weights)
+
+				versionCookie := &http.Cookie{
+					Name:     VERSION_COOKIE_NAME,
+					HttpOnly: false,
+					Path:     "/",
+					Expires:  time.Now().Add(time.Hour),
+					Value:    version,
+				}
+				http.SetCookie(rw, versionCookie)
+				rw.Header().Set("Cache-Control", "no-store")
+			} else if len(weights) == 1 {
+				// No rollout in effect - just the plain single default
+				// version, with no tracking cookie and no cache-control
+				// override so the response stays cacheable.
+				version = weights[0].Version
 			}
 
 			version = url.PathEscape(version)
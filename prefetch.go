@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+)
+
+// reAssetRef pulls src=/href= references to .js/.css files out of an HTML
+// document, used to prefetch an entry point's chunks without pulling in a
+// full HTML parser.
+var reAssetRef = regexp.MustCompile(`(?:src|href)="([^"]+\.(?:js|css))"`)
+
+// prefetchVersion fetches version's index.html and the JS/CSS chunks it
+// references, populating store directly - this bypasses the public
+// fileServer's singleflight/TTL machinery, since nothing is waiting on
+// these fetches. It's used by the admin API's POST /prefetch/{version} and
+// automatically whenever defaultVersionPoller observes a new default
+// version, to avoid a thundering-herd cache miss right after a deploy.
+func prefetchVersion(client *http.Client, sources []Source, store BlobStore, version string) error {
+	indexName := path.Join("/", version, "index.html")
+	index, err := prefetchOne(client, sources, store, indexName)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range extractAssetRefs(index) {
+		assetName := path.Join("/", version, ref)
+		if _, err := prefetchOne(client, sources, store, assetName); err != nil {
+			log.Printf("Prefetching %s: %s", assetName, err.Error())
+		}
+	}
+	return nil
+}
+
+func prefetchOne(client *http.Client, sources []Source, store BlobStore, name string) ([]byte, error) {
+	res, err := fetchFromSources(client, sources, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.Put(name, Meta{StatusCode: res.StatusCode, Header: res.Header}, bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// extractAssetRefs returns the deduplicated list of .js/.css references
+// found in an HTML document's src/href attributes, in first-seen order.
+func extractAssetRefs(html []byte) []string {
+	matches := reAssetRef.FindAllSubmatch(html, -1)
+	seen := map[string]bool{}
+	refs := make([]string, 0, len(matches))
+	for _, m := range matches {
+		ref := string(m[1])
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+	return refs
+}
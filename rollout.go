@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+// RolloutCookieName identifies a client across requests for the purpose of
+// percentage-based rollouts, so that a given client deterministically lands
+// on the same version for as long as the rollout weights don't change.
+const RolloutCookieName = "cra-rollout-id"
+
+// VersionWeight is one entry in a weighted rollout: Weight out of the sum of
+// all entries' weights is the share of clients that should get Version.
+// This is the JSON shape default-version.json is expected to hold.
+type VersionWeight struct {
+	Version string `json:"version"`
+	Weight  int    `json:"weight"`
+}
+
+// selectRolloutVersion picks a version from weights for the current
+// request, reading (or assigning, if absent) the long-lived rollout id
+// cookie that pins the choice to this client.
+func selectRolloutVersion(rw http.ResponseWriter, req *http.Request, weights []VersionWeight) string {
+	rolloutID := rolloutID(rw, req)
+	return selectWeightedVersion(weights, rolloutID)
+}
+
+// rolloutID returns the client's rollout id, reading it from
+// RolloutCookieName if present, otherwise generating and setting one.
+func rolloutID(rw http.ResponseWriter, req *http.Request) string {
+	if cookie, err := req.Cookie(RolloutCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	id := newRolloutID()
+	http.SetCookie(rw, &http.Cookie{
+		Name: RolloutCookieName,
+		// Not read or modified by client code.
+		HttpOnly: true,
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		Value:    id,
+	})
+	return id
+}
+
+func newRolloutID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf) // crypto/rand.Read on supported platforms does not fail
+	return hex.EncodeToString(buf)
+}
+
+// selectWeightedVersion deterministically maps rolloutID onto one of
+// weights, so the same client always gets the same answer while the
+// weights are unchanged. weights with a non-positive total, or an empty
+// list, resolve to the first entry (or "" if there is none).
+func selectWeightedVersion(weights []VersionWeight, rolloutID string) string {
+	if len(weights) == 0 {
+		return ""
+	}
+
+	total := 0
+	for _, w := range weights {
+		total += w.Weight
+	}
+	if total <= 0 {
+		return weights[0].Version
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(rolloutID))
+	bucket := int(h.Sum32() % uint32(total))
+
+	cumulative := 0
+	for _, w := range weights {
+		cumulative += w.Weight
+		if bucket < cumulative {
+			return w.Version
+		}
+	}
+	return weights[len(weights)-1].Version
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestSelectWeightedVersionDeterministic(t *testing.T) {
+	weights := []VersionWeight{{Version: "v1", Weight: 90}, {Version: "v2", Weight: 10}}
+
+	first := selectWeightedVersion(weights, "client-a")
+	for i := 0; i < 50; i++ {
+		if got := selectWeightedVersion(weights, "client-a"); got != first {
+			t.Fatalf("selectWeightedVersion is not deterministic: got %q then %q for the same rolloutID", first, got)
+		}
+	}
+}
+
+func TestSelectWeightedVersionDistribution(t *testing.T) {
+	weights := []VersionWeight{{Version: "v1", Weight: 90}, {Version: "v2", Weight: 10}}
+
+	counts := map[string]int{}
+	const n = 2000
+	for i := 0; i < n; i++ {
+		id := randomishID(i)
+		counts[selectWeightedVersion(weights, id)]++
+	}
+
+	if counts["v1"] == 0 || counts["v2"] == 0 {
+		t.Fatalf("expected both versions to be selected across %d clients, got %v", n, counts)
+	}
+
+	// With a 90/10 split, v1 should be a clear majority - a generous bound
+	// to avoid flaking while still catching a badly broken distribution.
+	if counts["v1"] < counts["v2"] {
+		t.Errorf("expected v1 (weight 90) to be selected more often than v2 (weight 10), got %v", counts)
+	}
+}
+
+func TestSelectWeightedVersionEdgeCases(t *testing.T) {
+	if got := selectWeightedVersion(nil, "client-a"); got != "" {
+		t.Errorf("selectWeightedVersion(nil) = %q, want empty string", got)
+	}
+
+	single := []VersionWeight{{Version: "v1", Weight: 100}}
+	if got := selectWeightedVersion(single, "client-a"); got != "v1" {
+		t.Errorf("selectWeightedVersion(single entry) = %q, want v1", got)
+	}
+
+	zeroWeight := []VersionWeight{{Version: "v1", Weight: 0}, {Version: "v2", Weight: 0}}
+	if got := selectWeightedVersion(zeroWeight, "client-a"); got != "v1" {
+		t.Errorf("selectWeightedVersion(all-zero weights) = %q, want first entry v1", got)
+	}
+}
+
+func randomishID(i int) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 8)
+	n := i
+	for j := range b {
+		b[j] = alphabet[(n+j*31)%len(alphabet)]
+		n /= len(alphabet)
+	}
+	return string(b)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Source is one upstream to fetch cache misses from. Modeled on GOPROXY's
+// proxy list semantics: a list of sources is tried in order, falling
+// through to the next one under certain failure conditions.
+type Source struct {
+	URL *url.URL
+	// FallBackOnError controls what happens when this source returns
+	// anything other than a usable response or a 404/410 (which always
+	// fall through): if true, the next source is tried; if false, the
+	// error is returned to the caller.
+	FallBackOnError bool
+}
+
+// SourceConfig is the JSON shape for CRA_PROXY_SOURCES_CONFIG.
+type SourceConfig struct {
+	URL             string `json:"url"`
+	FallBackOnError bool   `json:"fallBackOnError"`
+}
+
+// parseSourceList parses a GOPROXY-style comma/pipe separated source list:
+// sources are tried in order on a miss. The separator before a source
+// governs fallback from the *previous* source: "," only falls through on a
+// 404/410, "|" also falls through on any other error.
+func parseSourceList(spec string) ([]Source, error) {
+	var sources []Source
+	for spec != "" {
+		entry := spec
+		var sep byte
+		if idx := strings.IndexAny(spec, ",|"); idx != -1 {
+			entry = spec[:idx]
+			sep = spec[idx]
+			spec = spec[idx+1:]
+		} else {
+			spec = ""
+		}
+
+		u, err := url.Parse(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, Source{URL: u, FallBackOnError: sep == '|'})
+	}
+	return sources, nil
+}
+
+// resolve builds the upstream URL for name against this source.
+func (src Source) resolve(name string) *url.URL {
+	return &url.URL{
+		Path:   path.Join(src.URL.Path, name),
+		Scheme: src.URL.Scheme,
+		Host:   src.URL.Host,
+	}
+}
+
+// rotateSources returns sources starting at index start (wrapping around),
+// preserving their relative order - used by defaultVersionPoller so that
+// repeated polls spread across all configured sources instead of always
+// hitting the first one.
+func rotateSources(sources []Source, start int) []Source {
+	if len(sources) == 0 {
+		return sources
+	}
+	start = start % len(sources)
+	rotated := make([]Source, len(sources))
+	copy(rotated, sources[start:])
+	copy(rotated[len(sources)-start:], sources[:start])
+	return rotated
+}
+
+// fetchFromSources tries sources in order for name, always falling through
+// on 404/410, and falling through on any other error or 5xx only when the
+// source that failed has FallBackOnError set. decorate, if non-nil, can add
+// headers (e.g. conditional revalidation headers) to each attempt.
+func fetchFromSources(client *http.Client, sources []Source, name string, decorate func(*http.Request)) (*http.Response, error) {
+	var lastErr error
+	for i, src := range sources {
+		req, err := http.NewRequest(http.MethodGet, src.resolve(name).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if decorate != nil {
+			decorate(req)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			if src.FallBackOnError && i < len(sources)-1 {
+				continue
+			}
+			return nil, err
+		}
+
+		if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+			res.Body.Close()
+			lastErr = fmt.Errorf("HTTP %s from %s", res.Status, src.URL)
+			continue
+		}
+		if res.StatusCode >= 500 && src.FallBackOnError && i < len(sources)-1 {
+			res.Body.Close()
+			lastErr = fmt.Errorf("HTTP %s from %s", res.Status, src.URL)
+			continue
+		}
+
+		return res, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no sources configured")
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseSourceList(t *testing.T) {
+	cases := []struct {
+		name string
+		spec string
+		want []Source
+	}{
+		{
+			name: "empty",
+			spec: "",
+			want: nil,
+		},
+		{
+			name: "single",
+			spec: "https://a.example.com",
+			want: []Source{{FallBackOnError: false}},
+		},
+		{
+			name: "comma falls back only on 404/410",
+			spec: "https://a.example.com,https://b.example.com",
+			want: []Source{{FallBackOnError: false}, {FallBackOnError: false}},
+		},
+		{
+			name: "pipe falls back on any error",
+			spec: "https://a.example.com|https://b.example.com",
+			want: []Source{{FallBackOnError: true}, {FallBackOnError: false}},
+		},
+		{
+			name: "mixed separators",
+			spec: "https://a.example.com|https://b.example.com,https://c.example.com",
+			want: []Source{
+				{FallBackOnError: true},
+				{FallBackOnError: false},
+				{FallBackOnError: false},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseSourceList(c.spec)
+			if err != nil {
+				t.Fatalf("parseSourceList(%q): %s", c.spec, err.Error())
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("parseSourceList(%q) = %d sources, want %d", c.spec, len(got), len(c.want))
+			}
+			for i := range got {
+				if got[i].FallBackOnError != c.want[i].FallBackOnError {
+					t.Errorf("source %d: FallBackOnError = %v, want %v", i, got[i].FallBackOnError, c.want[i].FallBackOnError)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateSources(t *testing.T) {
+	a, b, c := Source{URL: mustParseURL("https://a")}, Source{URL: mustParseURL("https://b")}, Source{URL: mustParseURL("https://c")}
+	sources := []Source{a, b, c}
+
+	cases := []struct {
+		start int
+		want  []Source
+	}{
+		{start: 0, want: []Source{a, b, c}},
+		{start: 1, want: []Source{b, c, a}},
+		{start: 2, want: []Source{c, a, b}},
+		{start: 3, want: []Source{a, b, c}}, // wraps
+	}
+
+	for _, c := range cases {
+		got := rotateSources(sources, c.start)
+		for i := range got {
+			if got[i].URL.String() != c.want[i].URL.String() {
+				t.Errorf("rotateSources(start=%d)[%d] = %s, want %s", c.start, i, got[i].URL, c.want[i].URL)
+			}
+		}
+	}
+}
+
+func mustParseURL(raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}